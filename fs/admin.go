@@ -0,0 +1,111 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/minio/minfs/meta"
+)
+
+// serveAdmin runs the admin HTTP server exposing /metrics, /debug/pprof,
+// /healthz and /ops. It is only started when Config.adminAddr is set, since
+// none of these endpoints carry authentication of their own.
+func (mfs *MinFS) serveAdmin() {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", mfs.handleMetrics)
+	mux.HandleFunc("/healthz", mfs.handleHealthz)
+	mux.HandleFunc("/ops", mfs.handleOps)
+
+	// net/http/pprof registers its handlers on http.DefaultServeMux at
+	// import time; since the admin server uses its own mux, its handlers
+	// are wired up here by hand instead.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mfs.log.Println("Serving admin endpoint on", mfs.config.adminAddr)
+	if err := http.ListenAndServe(mfs.config.adminAddr, mux); err != nil {
+		mfs.log.Println("Admin server exited:", err)
+	}
+}
+
+// handleMetrics serves mfs's current state in Prometheus text exposition
+// format.
+func (mfs *MinFS) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(mfs.metricsText()))
+}
+
+// handleHealthz reports liveness: 200 once the cache database has been
+// opened by Serve.
+func (mfs *MinFS) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if mfs.db == nil {
+		http.Error(w, "minfs: not yet serving", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// opsEntry describes one pending write-back sync journal entry, for the
+// /ops endpoint.
+type opsEntry struct {
+	Seq  uint64         `json:"seq"`
+	Move *MoveOperation `json:"move,omitempty"`
+	Copy *CopyOperation `json:"copy,omitempty"`
+	Put  *PutOperation  `json:"put,omitempty"`
+}
+
+// handleOps dumps the pending write-back sync journal as JSON, read
+// directly from syncBucket rather than draining the live syncChan, so
+// inspecting it has no effect on in-flight operations.
+func (mfs *MinFS) handleOps(w http.ResponseWriter, r *http.Request) {
+	var entries []opsEntry
+
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		bucket := tx.Bucket(syncBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			entry := &journalEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			entries = append(entries, opsEntry{
+				Seq:  entry.Seq,
+				Move: entry.Move,
+				Copy: entry.Copy,
+				Put:  entry.Put,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
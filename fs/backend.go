@@ -0,0 +1,126 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Backend describes a single S3-compatible endpoint federated under the
+// MinFS mountpoint. Name is the directory the backend is exposed under at
+// the mount root when more than one backend is configured; Bucket is the
+// bucket within that endpoint MinFS serves.
+type Backend struct {
+	Name   string `yaml:"name" json:"name"`
+	Bucket string `yaml:"bucket" json:"bucket"`
+
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	Insecure bool   `yaml:"insecure" json:"insecure"`
+
+	AccessKey   string `yaml:"accessKey" json:"accessKey"`
+	SecretKey   string `yaml:"secretKey" json:"secretKey"`
+	SecretToken string `yaml:"secretToken" json:"secretToken"`
+
+	// credsProvider, when set, takes precedence over AccessKey/SecretKey
+	// for this backend only. There is no config-file knob for it; it is
+	// set by callers constructing Backend values in code (LDAP, STS).
+	credsProvider CredentialsProvider
+
+	target *url.URL
+}
+
+// url returns the *url.URL addressing Endpoint/Bucket, matching the form
+// Config.target took before federation was introduced: Host/Scheme name
+// the endpoint, Path carries the bucket.
+func (b *Backend) url() (*url.URL, error) {
+	if b.target != nil {
+		return b.target, nil
+	}
+
+	endpoint := b.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if b.Insecure {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + strings.TrimPrefix(b.Bucket, "/")
+
+	b.target = u
+	return u, nil
+}
+
+// backendsFile is the on-disk shape of a federation config file.
+type backendsFile struct {
+	Backends []Backend `yaml:"backends" json:"backends"`
+}
+
+// LoadBackendsFile reads a YAML or JSON file (selected by the ".yaml"/
+// ".yml" extension, everything else is parsed as JSON) describing the
+// backends to federate under a single mount, e.g.:
+//
+//	backends, err := LoadBackendsFile(path)
+//	if err != nil {
+//		...
+//	}
+//	minfs.New(minfs.SetTargets(backends), ...)
+func LoadBackendsFile(path string) ([]Backend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file backendsFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("minfs: parsing backends file %s: %w", path, err)
+	}
+
+	if len(file.Backends) == 0 {
+		return nil, fmt.Errorf("minfs: backends file %s defines no backends", path)
+	}
+
+	seen := map[string]bool{}
+	for i, b := range file.Backends {
+		if b.Name == "" {
+			return nil, fmt.Errorf("minfs: backends file %s: backend %d has no name", path, i)
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("minfs: backends file %s: duplicate backend name %q", path, b.Name)
+		}
+		seen[b.Name] = true
+	}
+
+	return file.Backends, nil
+}
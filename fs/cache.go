@@ -0,0 +1,407 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// cacheIdxBucket is the meta.DB bucket holding the access-time index used
+// to pick eviction candidates: one entry per cached object, keyed by its
+// object path.
+const cacheIdxBucket = "cacheidx/"
+
+// EvictionKind selects the algorithm CachePolicy uses to rank eviction
+// candidates.
+type EvictionKind string
+
+const (
+	// EvictLRU evicts the least-recently-accessed cold file first.
+	EvictLRU EvictionKind = "lru"
+	// EvictLFU evicts the least-frequently-accessed cold file first.
+	EvictLFU EvictionKind = "lfu"
+	// EvictTTL evicts any cold file whose last access is older than
+	// CachePolicy.TTL, regardless of ordering.
+	EvictTTL EvictionKind = "ttl"
+)
+
+// CachePolicy configures how MonitorCache reclaims space under cfg.cache
+// once usage exceeds cfg.quota.
+type CachePolicy struct {
+	Kind EvictionKind
+	TTL  time.Duration
+
+	pinned []string
+}
+
+// LRU returns a CachePolicy that evicts the least-recently-accessed cold
+// files first. This is the default.
+func LRU() CachePolicy { return CachePolicy{Kind: EvictLRU} }
+
+// LFU returns a CachePolicy that evicts the least-frequently-accessed cold
+// files first.
+func LFU() CachePolicy { return CachePolicy{Kind: EvictLFU} }
+
+// TTL returns a CachePolicy that evicts any cold file whose last access is
+// older than d.
+func TTL(d time.Duration) CachePolicy { return CachePolicy{Kind: EvictTTL, TTL: d} }
+
+// Pinned returns a copy of p that never evicts files under prefix.
+func (p CachePolicy) Pinned(prefix string) CachePolicy {
+	p.pinned = append(append([]string(nil), p.pinned...), prefix)
+	return p
+}
+
+func (p CachePolicy) isPinnedPrefix(objPath string) bool {
+	for _, prefix := range p.pinned {
+		if strings.HasPrefix(objPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheStats reports cache hit/miss/eviction counters, for the
+// status/metrics endpoint.
+type CacheStats struct {
+	Hits           int64
+	Misses         int64
+	Evictions      int64
+	BytesReclaimed int64
+	UsedBytes      int64
+}
+
+// cacheMetrics holds the atomic counters backing CacheStats.
+type cacheMetrics struct {
+	hits           int64
+	misses         int64
+	evictions      int64
+	bytesReclaimed int64
+}
+
+// cacheState tracks current cache usage and lets Open callers block until
+// space is reclaimed instead of overshooting cfg.quota.
+type cacheState struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	usedBytes int64
+
+	pinned map[string]bool
+}
+
+func newCacheState() *cacheState {
+	cs := &cacheState{pinned: map[string]bool{}}
+	cs.cond = sync.NewCond(&cs.mu)
+	return cs
+}
+
+// cacheIndexEntry is the on-disk representation of a cached object's
+// access-time index entry.
+type cacheIndexEntry struct {
+	Path        string
+	CachePath   string
+	Size        int64
+	AccessedAt  time.Time
+	AccessCount int64
+	Dirty       bool
+
+	// Ino is the iNode this entry's manifest (if any) is stored under. It
+	// is only meaningful for whole-resource entries (Path not "chunk:"
+	// prefixed); evictEntry uses it to release the manifest's chunk
+	// references when a cold file is reclaimed.
+	Ino uint64
+}
+
+// CacheStats returns a snapshot of the cache's current hit/miss/eviction
+// counters and usage.
+func (mfs *MinFS) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:           atomic.LoadInt64(&mfs.cacheMetrics.hits),
+		Misses:         atomic.LoadInt64(&mfs.cacheMetrics.misses),
+		Evictions:      atomic.LoadInt64(&mfs.cacheMetrics.evictions),
+		BytesReclaimed: atomic.LoadInt64(&mfs.cacheMetrics.bytesReclaimed),
+		UsedBytes:      atomic.LoadInt64(&mfs.cache.usedBytes),
+	}
+}
+
+// recordCacheHit bumps the cache hit counter, for a caller that just
+// served data straight from the local cache without fetching it.
+func (mfs *MinFS) recordCacheHit() {
+	atomic.AddInt64(&mfs.cacheMetrics.hits, 1)
+}
+
+// recordCacheMiss bumps the cache miss counter, for a caller that had to
+// fetch data because it wasn't already in the local cache.
+func (mfs *MinFS) recordCacheMiss() {
+	atomic.AddInt64(&mfs.cacheMetrics.misses, 1)
+}
+
+// Pin marks objPath (and, being a prefix match, anything under it) as
+// exempt from eviction until Unpin is called.
+func (mfs *MinFS) Pin(objPath string) error {
+	mfs.cache.mu.Lock()
+	mfs.cache.pinned[objPath] = true
+	mfs.cache.mu.Unlock()
+	return nil
+}
+
+// Unpin reverses a prior Pin.
+func (mfs *MinFS) Unpin(objPath string) error {
+	mfs.cache.mu.Lock()
+	delete(mfs.cache.pinned, objPath)
+	mfs.cache.mu.Unlock()
+	return nil
+}
+
+func (mfs *MinFS) isPinned(objPath string) bool {
+	mfs.cache.mu.Lock()
+	defer mfs.cache.mu.Unlock()
+
+	for prefix := range mfs.cache.pinned {
+		if strings.HasPrefix(objPath, prefix) {
+			return true
+		}
+	}
+	return mfs.config.cachePolicy.isPinnedPrefix(objPath)
+}
+
+// touchCacheIndex records an access against objPath in the cacheidx/
+// bucket, bumping its access time and access count and associating it
+// with ino (0 if not applicable, see cacheIndexEntry.Ino). Acquire and
+// Release call this on every open/close so eviction can tell cold files
+// from hot ones; it never changes the tracked size, which is kept current
+// by updateCacheSize from the read/write path. It does not affect the
+// hit/miss counters -- call recordCacheHit/recordCacheMiss at the point a
+// fetch decision is actually made, since a single open/close does not
+// itself indicate whether the data was served from cache.
+func (mfs *MinFS) touchCacheIndex(objPath string, ino uint64) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(cacheIdxBucket))
+		if err != nil {
+			return err
+		}
+
+		entry := cacheIndexEntry{}
+		if data := bucket.Get([]byte(objPath)); data != nil {
+			_ = json.Unmarshal(data, &entry)
+		}
+
+		entry.Path = objPath
+		entry.Ino = ino
+		entry.AccessedAt = time.Now()
+		entry.AccessCount++
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(objPath), data)
+	})
+}
+
+// updateCacheSize records objPath's current local cachePath, size and
+// dirty flag, adjusting the running usedBytes total by the delta. The
+// read/write path calls this whenever a cache file is allocated, grown or
+// flushed.
+func (mfs *MinFS) updateCacheSize(objPath, cachePath string, size int64, dirty bool) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(cacheIdxBucket))
+		if err != nil {
+			return err
+		}
+
+		entry := cacheIndexEntry{}
+		if data := bucket.Get([]byte(objPath)); data != nil {
+			_ = json.Unmarshal(data, &entry)
+		}
+
+		prevSize := entry.Size
+		entry.Path = objPath
+		entry.CachePath = cachePath
+		entry.Size = size
+		entry.Dirty = dirty
+		if entry.AccessedAt.IsZero() {
+			entry.AccessedAt = time.Now()
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		atomic.AddInt64(&mfs.cache.usedBytes, size-prevSize)
+
+		return bucket.Put([]byte(objPath), data)
+	})
+}
+
+// WaitForCacheSpace blocks until cache usage is back under cfg.quota,
+// providing backpressure so that Open doesn't keep filling a full cache
+// while eviction is catching up.
+func (mfs *MinFS) WaitForCacheSpace(ctx context.Context) error {
+	if mfs.config.quota <= 0 {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		mfs.cache.mu.Lock()
+		for mfs.cache.usedBytes >= mfs.config.quota {
+			mfs.cache.cond.Wait()
+		}
+		mfs.cache.mu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MonitorCache periodically reclaims cache space once usage exceeds
+// cfg.quota, according to cfg.cachePolicy. It runs for the lifetime of the
+// mount, started from Serve().
+func (mfs *MinFS) MonitorCache() {
+	interval := mfs.config.cacheMonitorInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := mfs.evict(); err != nil {
+			mfs.log.Println("cache: eviction pass failed:", err)
+		}
+	}
+}
+
+// evict reclaims cold, non-dirty, non-pinned cache entries until usage is
+// back under cfg.quota (or EvictTTL entries have all been swept).
+func (mfs *MinFS) evict() error {
+	if mfs.config.quota <= 0 {
+		return nil
+	}
+
+	var entries []cacheIndexEntry
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		bucket := tx.Bucket(cacheIdxBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var entry cacheIndexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	policy := mfs.config.cachePolicy
+
+	if policy.Kind == EvictTTL {
+		cutoff := time.Now().Add(-policy.TTL)
+		for _, entry := range entries {
+			if entry.AccessedAt.Before(cutoff) {
+				mfs.evictEntry(entry)
+			}
+		}
+		mfs.cache.cond.Broadcast()
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if policy.Kind == EvictLFU {
+			return entries[i].AccessCount < entries[j].AccessCount
+		}
+		return entries[i].AccessedAt.Before(entries[j].AccessedAt)
+	})
+
+	for _, entry := range entries {
+		if atomic.LoadInt64(&mfs.cache.usedBytes) < mfs.config.quota {
+			break
+		}
+		mfs.evictEntry(entry)
+	}
+
+	mfs.cache.cond.Broadcast()
+	return nil
+}
+
+// evictEntry drops a single cold cache entry: it is skipped if dirty
+// (unsynced writes) or pinned. A "chunk:"-prefixed entry is additionally
+// skipped while its refcount bucket entry shows it is still referenced by
+// some file's manifest -- eviction never removes a chunk out from under a
+// live manifest, even a cold one. A whole-resource (non "chunk:") entry
+// instead releases its own manifest via releaseManifest before it is
+// dropped, dereferencing every chunk it alone was keeping alive -- without
+// this, a file's chunks keep a refcount >= 1 forever once opened, and
+// nothing is ever evictable.
+func (mfs *MinFS) evictEntry(entry cacheIndexEntry) {
+	if entry.Dirty || mfs.isPinned(entry.Path) {
+		return
+	}
+
+	if hash, ok := dedupKeyForPath(entry.Path); ok {
+		if count, err := mfs.chunkRefCount(hash); err != nil {
+			mfs.log.Println("cache: unable to check refcount for", entry.Path, err)
+			return
+		} else if count > 0 {
+			return
+		}
+	} else if err := mfs.releaseManifest(entry.Ino); err != nil {
+		mfs.log.Println("cache: unable to release manifest for", entry.Path, err)
+		return
+	}
+
+	if err := os.Remove(entry.CachePath); err != nil && !os.IsNotExist(err) {
+		mfs.log.Println("cache: unable to evict", entry.Path, err)
+		return
+	}
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		bucket := tx.Bucket(cacheIdxBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(entry.Path))
+	}); err != nil {
+		mfs.log.Println("cache: unable to remove index entry for", entry.Path, err)
+		return
+	}
+
+	atomic.AddInt64(&mfs.cache.usedBytes, -entry.Size)
+	atomic.AddInt64(&mfs.cacheMetrics.bytesReclaimed, entry.Size)
+	atomic.AddInt64(&mfs.cacheMetrics.evictions, 1)
+}
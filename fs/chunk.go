@@ -0,0 +1,462 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minfs/meta"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// chunkMinSize is the smallest chunk splitChunks will produce, except
+	// for the final chunk, which holds whatever data remains and may be
+	// shorter.
+	chunkMinSize = 64 * 1024
+	// chunkMaxSize is the largest chunk splitChunks will ever produce --
+	// a boundary is forced here even if the rolling hash hasn't found one.
+	chunkMaxSize = 4 * 1024 * 1024
+	// chunkMaskBits picks boundaries so that the average chunk size is
+	// around 2^chunkMaskBits bytes (1MiB).
+	chunkMaskBits = 20
+	chunkMask     = (uint64(1) << chunkMaskBits) - 1
+)
+
+// gearTable is the Gear-hashing lookup table: gearHash accumulates
+// gearTable[b] into a 64-bit shift register one input byte at a time. Since
+// the register is 64 bits wide and every byte shifts it left by one, a
+// byte's contribution is shifted entirely out after 64 more bytes are
+// processed -- giving the hash an effective 64-byte sliding window without
+// having to maintain one explicitly.
+var gearTable [256]uint64
+
+func init() {
+	// A fixed seed keeps chunk boundaries -- and therefore content
+	// addresses -- stable across restarts and across machines.
+	rnd := rand.New(rand.NewSource(0x6d696e6673))
+	for i := range gearTable {
+		gearTable[i] = rnd.Uint64()
+	}
+}
+
+// chunkSpan is one entry of a file's manifest: the object bytes
+// [Offset, Offset+Length) are stored as the content-addressed chunk Hash.
+type chunkSpan struct {
+	Offset int64
+	Length int64
+	Hash   string
+}
+
+// splitChunks partitions data into content-defined chunks using Gear
+// hashing, clamped to [chunkMinSize, chunkMaxSize]: a boundary falls
+// wherever the low chunkMaskBits bits of the rolling hash are zero, which
+// on random data produces an average chunk size of roughly 2^chunkMaskBits
+// bytes. Because boundaries are a function of content rather than offset,
+// an insertion or deletion only changes the chunks touching the edit --
+// the rest hash identically and are deduplicated against what's already
+// on disk.
+func splitChunks(data []byte) []chunkSpan {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var spans []chunkSpan
+	var h uint64
+	start := 0
+
+	cut := func(end int) {
+		sum := sha256.Sum256(data[start:end])
+		spans = append(spans, chunkSpan{
+			Offset: int64(start),
+			Length: int64(end - start),
+			Hash:   hex.EncodeToString(sum[:]),
+		})
+		start = end
+		h = 0
+	}
+
+	for i, b := range data {
+		h = h<<1 + gearTable[b]
+
+		size := i - start + 1
+		if size >= chunkMaxSize {
+			cut(i + 1)
+			continue
+		}
+		if size >= chunkMinSize && h&chunkMask == 0 {
+			cut(i + 1)
+		}
+	}
+
+	if start < len(data) {
+		cut(len(data))
+	}
+
+	return spans
+}
+
+// chunkPath returns the on-disk path a chunk with the given content
+// address is stored under, fanned out by the first byte of its hash to
+// keep any one directory from holding too many entries.
+func chunkPath(cacheDir, hash string) string {
+	return filepath.Join(cacheDir, "chunks", hash[:2], hash)
+}
+
+// manifestBucket is the meta.DB bucket holding ino's chunk manifest.
+func manifestBucket(ino uint64) string {
+	return fmt.Sprintf("chunks/%d/", ino)
+}
+
+// manifestKey is the single key a manifest is stored under within its
+// bucket -- manifests are always read and rewritten as a whole.
+const manifestKey = "manifest"
+
+// chunkRefBucket is the meta.DB bucket mapping a chunk's content address to
+// the number of manifests currently referencing it, so unreferenced
+// chunks can be identified and reclaimed.
+const chunkRefBucket = "chunkrefs/"
+
+// errNoManifest is returned by getManifest when ino has no chunk manifest
+// yet -- i.e. the object has never been chunked into the local cache.
+var errNoManifest = errors.New("minfs: no chunk manifest")
+
+// getManifest returns ino's chunk manifest.
+func (mfs *MinFS) getManifest(ino uint64) ([]chunkSpan, error) {
+	var spans []chunkSpan
+
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		bucket := tx.Bucket(manifestBucket(ino))
+		if bucket == nil {
+			return errNoManifest
+		}
+
+		data := bucket.Get([]byte(manifestKey))
+		if data == nil {
+			return errNoManifest
+		}
+
+		return json.Unmarshal(data, &spans)
+	})
+
+	return spans, err
+}
+
+// chunkRefCount returns hash's current reference count.
+func (mfs *MinFS) chunkRefCount(hash string) (int64, error) {
+	var count int64
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		bucket := tx.Bucket(chunkRefBucket)
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get([]byte(hash)); v != nil {
+			count = int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return count, err
+}
+
+// chunkRefDelta adjusts hash's reference count by delta, deleting the
+// counter entry entirely once it reaches zero.
+func chunkRefDelta(tx *meta.Tx, hash string, delta int64) (int64, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(chunkRefBucket))
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if v := bucket.Get([]byte(hash)); v != nil {
+		count = int64(binary.BigEndian.Uint64(v))
+	}
+	count += delta
+
+	if count <= 0 {
+		return 0, bucket.Delete([]byte(hash))
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(count))
+	return count, bucket.Put([]byte(hash), buf)
+}
+
+// cacheIndexKey is the cacheIdxBucket key a chunk's access-time/eviction
+// index entry is tracked under, distinguishing it from whole-resource
+// entries so evictEntry knows to consult its refcount before reclaiming it.
+func cacheIndexKey(hash string) string {
+	return "chunk:" + hash
+}
+
+// writeChunkFile writes data to disk under its content address unless a
+// copy that cacheLoad can read is there already, registering it in the
+// cache index. A copy that fails to load (such as one encrypted under a
+// previous SSE-C key) is rewritten under the current key. It never touches the
+// chunk's reference count -- callers that are adding a manifest reference
+// to hash must bump it themselves (see storeChunk); a caller that is only
+// populating the on-disk cache for a chunk it doesn't yet reference (see
+// loadChunk) must not, or the refcount would never reach zero again.
+func (mfs *MinFS) writeChunkFile(hash string, data []byte) error {
+	p := chunkPath(mfs.config.cache, hash)
+
+	if _, err := mfs.cacheLoad(p); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	if err := mfs.cacheSave(p, data); err != nil {
+		return err
+	}
+	return mfs.updateCacheSize(cacheIndexKey(hash), p, int64(len(data)), false)
+}
+
+// storeChunk writes data to disk under its content address if it isn't
+// there already (via writeChunkFile), and bumps its reference count.
+// Called with the same meta.Tx that rewrites the manifest referencing it,
+// so a chunk is never left on disk without a corresponding reference, or
+// vice versa.
+func (mfs *MinFS) storeChunk(tx *meta.Tx, hash string, data []byte) error {
+	if err := mfs.writeChunkFile(hash, data); err != nil {
+		return err
+	}
+
+	_, err := chunkRefDelta(tx, hash, 1)
+	return err
+}
+
+// derefChunk drops one reference to hash, deleting the on-disk chunk (and
+// its eviction index entry) once nothing references it any more.
+func (mfs *MinFS) derefChunk(tx *meta.Tx, hash string) error {
+	count, err := chunkRefDelta(tx, hash, -1)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	p := chunkPath(mfs.config.cache, hash)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return mfs.updateCacheSize(cacheIndexKey(hash), p, 0, false)
+}
+
+// rechunkAndStore splits data into content-defined chunks, stores any that
+// aren't already on disk, rewrites ino's manifest to match, and
+// dereferences any chunk the previous manifest used that the new one
+// doesn't. It is used both the first time an object is read into the
+// cache and whenever a dirty File is flushed.
+func (mfs *MinFS) rechunkAndStore(ino uint64, data []byte) ([]chunkSpan, error) {
+	spans := splitChunks(data)
+
+	raw := make(map[string][]byte, len(spans))
+	for _, span := range spans {
+		raw[span.Hash] = data[span.Offset : span.Offset+span.Length]
+	}
+
+	err := mfs.db.Update(func(tx *meta.Tx) error {
+		old, _ := mfs.getManifest(ino)
+
+		oldUsed := make(map[string]bool, len(old))
+		for _, span := range old {
+			oldUsed[span.Hash] = true
+		}
+
+		for hash, chunkData := range raw {
+			if oldUsed[hash] {
+				// Already counted for this manifest; only make sure it
+				// is on disk.
+				if err := mfs.writeChunkFile(hash, chunkData); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := mfs.storeChunk(tx, hash, chunkData); err != nil {
+				return err
+			}
+		}
+
+		for hash := range oldUsed {
+			if _, ok := raw[hash]; !ok {
+				if err := mfs.derefChunk(tx, hash); err != nil {
+					return err
+				}
+			}
+		}
+
+		manifestData, err := json.Marshal(spans)
+		if err != nil {
+			return err
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists([]byte(manifestBucket(ino)))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(manifestKey), manifestData)
+	})
+
+	return spans, err
+}
+
+// releaseManifest dereferences every chunk ino's manifest points at and
+// deletes the manifest itself. It is called by evictEntry when a cold
+// file's whole-resource cache entry is reclaimed, so the chunks that file
+// alone was keeping alive can themselves become eligible for eviction.
+func (mfs *MinFS) releaseManifest(ino uint64) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		bucket := tx.Bucket(manifestBucket(ino))
+		if bucket == nil {
+			return nil
+		}
+
+		data := bucket.Get([]byte(manifestKey))
+		if data == nil {
+			return nil
+		}
+
+		var spans []chunkSpan
+		if err := json.Unmarshal(data, &spans); err != nil {
+			return err
+		}
+
+		seen := make(map[string]bool, len(spans))
+		for _, span := range spans {
+			if seen[span.Hash] {
+				continue
+			}
+			seen[span.Hash] = true
+			if err := mfs.derefChunk(tx, span.Hash); err != nil {
+				return err
+			}
+		}
+
+		return bucket.Delete([]byte(manifestKey))
+	})
+}
+
+// loadChunk returns span's bytes, fetching it from the backend with a
+// ranged GetObject and caching it on disk if it isn't already cached.
+// Concurrent loadChunk calls for the same content address are serialized
+// through KeyedMutex so that two readers racing on the same chunk only
+// fetch it once.
+func (mfs *MinFS) loadChunk(ctx context.Context, backend, objPath string, span chunkSpan) ([]byte, error) {
+	p := chunkPath(mfs.config.cache, span.Hash)
+
+	if data, err := mfs.cacheLoad(p); err == nil {
+		mfs.recordCacheHit()
+		_ = mfs.touchCacheIndex(cacheIndexKey(span.Hash), 0)
+		return data, nil
+	}
+
+	unlock := mfs.km.Lock("chunk/" + span.Hash)
+	defer unlock()
+
+	// Another goroutine may have fetched it while we waited for the lock.
+	if data, err := mfs.cacheLoad(p); err == nil {
+		mfs.recordCacheHit()
+		_ = mfs.touchCacheIndex(cacheIndexKey(span.Hash), 0)
+		return data, nil
+	}
+
+	mfs.recordCacheMiss()
+	_ = mfs.touchCacheIndex(cacheIndexKey(span.Hash), 0)
+
+	api, err := mfs.getApi(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := mfs.backend(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	sse, err := mfs.serverSide()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := minio.GetObjectOptions{ServerSideEncryption: sse}
+	if err := opts.SetRange(span.Offset, span.Offset+span.Length-1); err != nil {
+		return nil, err
+	}
+
+	obj, err := api.GetObject(ctx, b.Bucket, objPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	data := make([]byte, span.Length)
+	if _, err := io.ReadFull(obj, data); err != nil {
+		return nil, err
+	}
+
+	// Only populate the on-disk cache here -- refcounting is owned solely
+	// by rechunkAndStore's manifest rewrites. A fetch is not itself a
+	// manifest reference (the manifest that led us here already holds
+	// one), so bumping the refcount on every fetch would let it drift
+	// above the number of manifests actually pointing at this chunk and
+	// never reach zero.
+	if err := mfs.writeChunkFile(span.Hash, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// spansInRange returns the manifest entries overlapping the half-open byte
+// range [offset, offset+size).
+func spansInRange(spans []chunkSpan, offset, size int64) []chunkSpan {
+	end := offset + size
+	var out []chunkSpan
+	for _, span := range spans {
+		if span.Offset >= end {
+			break
+		}
+		if span.Offset+span.Length <= offset {
+			continue
+		}
+		out = append(out, span)
+	}
+	return out
+}
+
+// dedupKeyForPath lets callers address a chunk's cache-index entry by the
+// same "chunk:"-prefixed key used elsewhere in this file, for the rare
+// caller outside chunk.go (currently only evictEntry) that needs to tell a
+// chunk entry apart from a whole-resource one.
+func dedupKeyForPath(objPath string) (hash string, ok bool) {
+	if !strings.HasPrefix(objPath, "chunk:") {
+		return "", false
+	}
+	return strings.TrimPrefix(objPath, "chunk:"), true
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config represents the configuration of a MinFS mount.
+type Config struct {
+	mountpoint string
+
+	// targets is the set of backends federated under mountpoint. A
+	// single backend presents its bucket directly at the mount root; more
+	// than one causes Root() to present a synthetic directory listing
+	// each backend by name. Configure via SetTargets, optionally loading
+	// it from a file with LoadBackendsFile.
+	targets []Backend
+
+	cache    string
+	quota    int64
+	basePath string
+
+	accountID string
+
+	gid uint32
+	uid uint32
+
+	accessKey   string
+	secretKey   string
+	secretToken string
+
+	mode os.FileMode
+
+	debug    bool
+	insecure bool
+
+	// credsProvider, when set, takes precedence over accessKey/secretKey
+	// and is consulted for every getApi() call so that long running
+	// mounts can survive credential rotation.
+	credsProvider CredentialsProvider
+
+	// serveMode selects which front-end(s) Serve() exposes the tree
+	// through. Defaults to ServeModeFUSE.
+	serveMode ServeMode
+
+	// webdavAddr is the "host:port" the WebDAV gateway listens on when
+	// serveMode is ServeModeWebDAV or ServeModeBoth. Defaults to ":8765".
+	webdavAddr string
+
+	// commitMode selects when a write is considered durable. Defaults to
+	// CommitWriteback.
+	commitMode CommitMode
+
+	// syncConcurrency is the number of write-back workers draining
+	// syncChan. Defaults to 4.
+	syncConcurrency int
+
+	// cachePolicy selects the eviction algorithm MonitorCache uses once
+	// cache usage exceeds quota. Defaults to LRU().
+	cachePolicy CachePolicy
+
+	// cacheMonitorInterval is how often MonitorCache checks usage
+	// against quota. Defaults to 30s.
+	cacheMonitorInterval time.Duration
+
+	// encryption configures server-side and cache-at-rest encryption.
+	encryption Encryption
+
+	// encryptionErr holds an error encountered while applying SetEncryption
+	// (currently, a failure to read Encryption.SSECKeyFile). SetEncryption
+	// can't return an error itself (it must match the func(*Config) option
+	// signature), so it stashes one here for validate to surface at New().
+	encryptionErr error
+
+	// adminAddr is the "host:port" the admin HTTP server (metrics,
+	// pprof, healthz, ops) listens on. Unset (the default) disables it
+	// entirely -- it is opt-in since it has no authentication of its own.
+	adminAddr string
+}
+
+// SetAdminAddr configures the listen address for the admin HTTP server
+// exposing /metrics (Prometheus format), /debug/pprof, /healthz and /ops.
+// Left unset, the admin server is not started.
+func SetAdminAddr(addr string) func(*Config) {
+	return func(c *Config) {
+		c.adminAddr = addr
+	}
+}
+
+// SetCachePolicy configures the eviction algorithm used once cache usage
+// exceeds quota.
+func SetCachePolicy(policy CachePolicy) func(*Config) {
+	return func(c *Config) {
+		c.cachePolicy = policy
+	}
+}
+
+// SetCacheMonitorInterval configures how often MonitorCache checks usage
+// against quota.
+func SetCacheMonitorInterval(d time.Duration) func(*Config) {
+	return func(c *Config) {
+		c.cacheMonitorInterval = d
+	}
+}
+
+// SetCommitMode selects when a write is considered durable: writethrough
+// blocks the originating FUSE call until the object store acknowledges
+// the write, writeback (the default) only waits for the write to be
+// durably journaled.
+func SetCommitMode(mode CommitMode) func(*Config) {
+	return func(c *Config) {
+		c.commitMode = mode
+	}
+}
+
+// SetSyncConcurrency configures the number of write-back workers draining
+// the sync pipeline.
+func SetSyncConcurrency(n int) func(*Config) {
+	return func(c *Config) {
+		c.syncConcurrency = n
+	}
+}
+
+// SetWebDAVAddr configures the listen address used by the WebDAV gateway.
+func SetWebDAVAddr(addr string) func(*Config) {
+	return func(c *Config) {
+		c.webdavAddr = addr
+	}
+}
+
+// ServeMode selects which front-end(s) Serve() exposes the MinFS tree
+// through.
+type ServeMode string
+
+const (
+	// ServeModeFUSE mounts the tree via FUSE only (the default).
+	ServeModeFUSE ServeMode = "fuse"
+	// ServeModeWebDAV serves the tree over WebDAV/HTTP only, for hosts
+	// where FUSE is unavailable (containers without /dev/fuse, Windows,
+	// macOS without osxfuse).
+	ServeModeWebDAV ServeMode = "webdav"
+	// ServeModeBoth runs both the FUSE mount and the WebDAV gateway.
+	ServeModeBoth ServeMode = "both"
+)
+
+// SetServeMode configures which front-end(s) Serve() exposes the tree
+// through. Unset, it defaults to ServeModeFUSE.
+func SetServeMode(mode ServeMode) func(*Config) {
+	return func(c *Config) {
+		c.serveMode = mode
+	}
+}
+
+// validate checks that the config has enough information to mount.
+func (c *Config) validate() error {
+	if c.encryptionErr != nil {
+		return fmt.Errorf("minfs: %w", c.encryptionErr)
+	}
+	if c.mountpoint == "" {
+		return errors.New("minfs: mountpoint is not configured")
+	}
+	if len(c.targets) == 0 {
+		return errors.New("minfs: no backends configured, see SetTargets")
+	}
+
+	names := map[string]bool{}
+	for _, b := range c.targets {
+		if b.Name == "" {
+			return errors.New("minfs: backend has no name")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("minfs: duplicate backend name %q", b.Name)
+		}
+		names[b.Name] = true
+
+		if b.Bucket == "" {
+			return fmt.Errorf("minfs: backend %q has no bucket", b.Name)
+		}
+		if b.Endpoint == "" {
+			return fmt.Errorf("minfs: backend %q has no endpoint", b.Name)
+		}
+
+		hasProvider := c.credsProvider != nil || b.credsProvider != nil
+		hasStaticKeys := (b.AccessKey != "" && b.SecretKey != "") || (c.accessKey != "" && c.secretKey != "")
+		if !hasProvider && !hasStaticKeys {
+			return fmt.Errorf("minfs: backend %q has no credentials provider or access/secret key configured", b.Name)
+		}
+	}
+
+	return nil
+}
+
+// SetTargets configures the backends MinFS federates under the
+// mountpoint. A single backend preserves the pre-federation behaviour of
+// presenting its bucket directly at the mount root; more than one causes
+// Root() to present a synthetic directory listing each backend by name.
+func SetTargets(backends []Backend) func(*Config) {
+	return func(c *Config) {
+		c.targets = backends
+	}
+}
+
+// SetCredentialsProvider configures mfs to source its S3 credentials from
+// the given CredentialsProvider instead of the static accessKey/secretKey
+// pair. This is the extension point used for LDAP, STS/web-identity and
+// IAM instance credentials.
+func SetCredentialsProvider(cp CredentialsProvider) func(*Config) {
+	return func(c *Config) {
+		c.credsProvider = cp
+	}
+}
+
+// accountCreds holds the static credentials taken from the environment,
+// used as a fallback when no CredentialsProvider is configured.
+type accountCreds struct {
+	AccessKey string
+	SecretKey string
+}
+
+// InitMinFSConfig returns the static access/secret key pair from the
+// MINFS_ACCESS_KEY and MINFS_SECRET_KEY environment variables (empty
+// strings when unset). It reads no configuration file.
+func InitMinFSConfig() (*accountCreds, error) {
+	return &accountCreds{
+		AccessKey: os.Getenv("MINFS_ACCESS_KEY"),
+		SecretKey: os.Getenv("MINFS_SECRET_KEY"),
+	}, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"fmt"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// CredentialsProvider wraps credentials.Provider so that MinFS can plug in
+// any minio-go credential source (LDAP, STS web-identity, IAM instance
+// credentials, ...) in place of a static accessKey/secretKey pair.
+//
+// getApi() calls Retrieve() on demand and relies on IsExpired() to decide
+// when to refresh, so long-running mounts transparently survive credential
+// rotation without needing to be remounted.
+type CredentialsProvider interface {
+	credentials.Provider
+}
+
+// NewStaticCredentialsProvider wraps a static accessKey/secretKey/token as a
+// CredentialsProvider, matching the default behaviour of getApi() prior to
+// this interface existing.
+func NewStaticCredentialsProvider(accessKey, secretKey, token string) CredentialsProvider {
+	return &credentials.Static{
+		Value: credentials.Value{
+			AccessKeyID:     accessKey,
+			SecretAccessKey: secretKey,
+			SessionToken:    token,
+		},
+	}
+}
+
+// NewSTSWebIdentityProvider returns a CredentialsProvider that exchanges a
+// JWT/OIDC identity token for temporary STS credentials via
+// AssumeRoleWithWebIdentity, refreshing the token on every expiry.
+func NewSTSWebIdentityProvider(stsEndpoint string, getToken func() (*credentials.WebIdentityToken, error)) (CredentialsProvider, error) {
+	return credentials.NewSTSWebIdentity(stsEndpoint, getToken)
+}
+
+// LDAPConfig holds what's needed to resolve a MinFS user to temporary STS
+// credentials via AssumeRoleWithLDAPIdentity. The STS server performs the
+// actual LDAP bind against Username/Password; MinFS never talks to the
+// LDAP server directly.
+type LDAPConfig struct {
+	// STSEndpoint is the MinIO STS endpoint used for
+	// AssumeRoleWithLDAPIdentity.
+	STSEndpoint string
+
+	// Username/Password are the LDAP credentials of the MinFS user.
+	Username string
+	Password string
+}
+
+// ldapProvider implements CredentialsProvider by exchanging the configured
+// LDAP username/password for temporary credentials via
+// AssumeRoleWithLDAPIdentity -- the STS server performs the authoritative
+// LDAP bind, so ldapProvider itself never talks to the LDAP server
+// directly.
+type ldapProvider struct {
+	creds *credentials.Credentials
+}
+
+// NewLDAPProvider returns a CredentialsProvider that assumes a role via
+// AssumeRoleWithLDAPIdentity, passing cfg's Username/Password straight
+// through for the STS server to bind as.
+func NewLDAPProvider(cfg LDAPConfig) (CredentialsProvider, error) {
+	if cfg.STSEndpoint == "" {
+		return nil, fmt.Errorf("minfs: LDAP provider requires STSEndpoint")
+	}
+
+	provider, err := credentials.NewLDAPIdentity(cfg.STSEndpoint, cfg.Username, cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("minfs: unable to initialize LDAP identity provider: %w", err)
+	}
+
+	return &ldapProvider{creds: provider}, nil
+}
+
+// Retrieve implements credentials.Provider, returning temporary STS
+// credentials assumed via AssumeRoleWithLDAPIdentity.
+func (p *ldapProvider) Retrieve() (credentials.Value, error) {
+	return p.creds.Get()
+}
+
+// IsExpired implements credentials.Provider.
+func (p *ldapProvider) IsExpired() bool {
+	return p.creds.IsExpired()
+}
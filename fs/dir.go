@@ -0,0 +1,197 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Dir represents a directory within a backend's bucket, or -- when dir is
+// nil and Backend is empty -- the synthetic federation root that lists
+// each configured Backend as a top-level directory. Root() only ever
+// produces a federation root when more than one backend is configured, so
+// a single-backend mount behaves exactly as it did before federation.
+type Dir struct {
+	dir *Dir
+	mfs *MinFS
+
+	// Backend is the name of the Backend this directory's Path is
+	// resolved against. Empty at the federation root.
+	Backend string
+	Path    string
+
+	UID  uint32
+	GID  uint32
+	Mode os.FileMode
+}
+
+// isFederationRoot reports whether d is the synthetic root listing
+// backends, rather than a directory within one of them.
+func (d *Dir) isFederationRoot() bool {
+	return d.dir == nil && d.Backend == ""
+}
+
+// Attr implements fs.Node.
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | d.Mode
+	a.Uid = d.UID
+	a.Gid = d.GID
+	return nil
+}
+
+// Lookup implements fs.NodeStringLookuper. At the federation root, name
+// selects a configured Backend; elsewhere it resolves against that
+// directory's backend bucket.
+func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	d.mfs.opCounters.inc("lookup")
+
+	if d.isFederationRoot() {
+		b, err := d.mfs.backend(name)
+		if err != nil {
+			return nil, fuse.ENOENT
+		}
+		return &Dir{
+			dir:     d,
+			mfs:     d.mfs,
+			Backend: b.Name,
+			UID:     d.UID,
+			GID:     d.GID,
+			Mode:    d.Mode,
+		}, nil
+	}
+
+	api, err := d.mfs.getApi(d.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := d.mfs.backend(d.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	childPath := path.Join(d.Path, name)
+
+	// A single-entry, non-recursive listing under childPath+"/" tells us
+	// whether name is a "directory" (shares a common prefix with other
+	// objects) without having to list the whole bucket.
+	for obj := range api.ListObjects(ctx, b.Bucket, minio.ListObjectsOptions{
+		Prefix:    childPath + "/",
+		Recursive: false,
+		MaxKeys:   1,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		return &Dir{
+			dir:     d,
+			mfs:     d.mfs,
+			Backend: d.Backend,
+			Path:    childPath,
+			UID:     d.UID,
+			GID:     d.GID,
+			Mode:    d.Mode,
+		}, nil
+	}
+
+	sse, err := d.mfs.serverSide()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := api.StatObject(ctx, b.Bucket, childPath, minio.StatObjectOptions{ServerSideEncryption: sse})
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+
+	ino, err := d.mfs.inodeFor(d.Backend, childPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		dir:     d,
+		mfs:     d.mfs,
+		Backend: d.Backend,
+		Path:    childPath,
+		Ino:     ino,
+		UID:     d.UID,
+		GID:     d.GID,
+		Mode:    d.mfs.config.mode,
+		Size:    uint64(info.Size),
+	}, nil
+}
+
+// ReadDirAll implements fs.HandleReadDirAller.
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	d.mfs.opCounters.inc("readdirall")
+
+	if d.isFederationRoot() {
+		dirents := make([]fuse.Dirent, 0, len(d.mfs.config.targets))
+		for _, b := range d.mfs.config.targets {
+			dirents = append(dirents, fuse.Dirent{Name: b.Name, Type: fuse.DT_Dir})
+		}
+		return dirents, nil
+	}
+
+	api, err := d.mfs.getApi(d.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := d.mfs.backend(d.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := d.Path
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var dirents []fuse.Dirent
+	for obj := range api.ListObjects(ctx, b.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: false,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if name == "" {
+			continue
+		}
+
+		typ := fuse.DT_File
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			typ = fuse.DT_Dir
+		}
+
+		dirents = append(dirents, fuse.Dirent{Name: name, Type: typ})
+	}
+
+	return dirents, nil
+}
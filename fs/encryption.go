@@ -0,0 +1,198 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// SSEMode selects the server-side encryption applied to objects written
+// through a mount.
+type SSEMode string
+
+const (
+	// SSENone disables server-side encryption (the default).
+	SSENone SSEMode = ""
+	// SSEC is customer-provided key encryption: the key in
+	// Encryption.SSECKeyFile never leaves the client, and is also used
+	// to encrypt the local cache at rest.
+	SSEC SSEMode = "sse-c"
+	// SSES3 is MinIO/S3-managed key encryption.
+	SSES3 SSEMode = "sse-s3"
+	// SSEKMS is KMS-managed key encryption, keyed by Encryption.KMSKeyID.
+	SSEKMS SSEMode = "sse-kms"
+)
+
+// Encryption configures server-side encryption for Get/Put/Copy/Stat
+// calls. Set it via SetEncryption, e.g. from a
+// `minfs mount --sse-c-key-file=...` CLI flag.
+type Encryption struct {
+	Mode SSEMode
+
+	// SSECKeyFile is a 32-byte raw key file used both for SSE-C requests
+	// and, since that key never leaves the client, to encrypt the local
+	// cache at rest. Never logged or persisted in meta.DB in plaintext.
+	SSECKeyFile string
+
+	// KMSKeyID is the key id used for SSE-KMS requests.
+	KMSKeyID string
+
+	key []byte
+}
+
+// SetEncryption configures server-side and cache-at-rest encryption. When
+// Mode is SSEC, the key file is read up front so a misconfigured mount
+// fails at New() rather than on the first write. A read failure here can't
+// be returned directly (SetEncryption must match the func(*Config) option
+// signature), so it's stashed on c.encryptionErr for validate to surface.
+func SetEncryption(enc Encryption) func(*Config) {
+	return func(c *Config) {
+		if enc.Mode == SSEC && enc.SSECKeyFile != "" {
+			key, err := ioutil.ReadFile(enc.SSECKeyFile)
+			if err != nil {
+				c.encryptionErr = fmt.Errorf("unable to read SSE-C key file %q: %w", enc.SSECKeyFile, err)
+				return
+			}
+			enc.key = key
+		}
+		c.encryption = enc
+	}
+}
+
+// serverSide returns the encrypt.ServerSide option to attach to
+// GetObject/PutObject/CopyObject/StatObject calls, or nil when no
+// encryption is configured.
+func (mfs *MinFS) serverSide() (encrypt.ServerSide, error) {
+	switch mfs.config.encryption.Mode {
+	case SSEC:
+		if len(mfs.config.encryption.key) != 32 {
+			return nil, errors.New("minfs: SSE-C key must be exactly 32 bytes")
+		}
+		return encrypt.NewSSEC(mfs.config.encryption.key)
+	case SSES3:
+		return encrypt.NewSSE(), nil
+	case SSEKMS:
+		return encrypt.NewSSEKMS(mfs.config.encryption.KMSKeyID, nil)
+	default:
+		return nil, nil
+	}
+}
+
+// cacheKey derives the AES-256-GCM key used to encrypt cache files at
+// rest from the configured SSE-C key. Re-keying (key rotation) takes
+// effect on the next write: existing cache files are re-encrypted lazily
+// as cacheSave rewrites them, rather than all at once.
+func (mfs *MinFS) cacheKey() ([]byte, bool) {
+	enc := mfs.config.encryption
+	if enc.Mode != SSEC || len(enc.key) == 0 {
+		return nil, false
+	}
+	sum := sha256.Sum256(enc.key)
+	return sum[:], true
+}
+
+// encryptCacheBytes encrypts data for at-rest storage when SSE-C is
+// configured, prefixing the GCM nonce. Without SSE-C, data passes through
+// unchanged.
+func (mfs *MinFS) encryptCacheBytes(data []byte) ([]byte, error) {
+	key, ok := mfs.cacheKey()
+	if !ok {
+		return data, nil
+	}
+
+	gcm, err := newCacheGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// decryptCacheBytes reverses encryptCacheBytes.
+func (mfs *MinFS) decryptCacheBytes(data []byte) ([]byte, error) {
+	key, ok := mfs.cacheKey()
+	if !ok {
+		return data, nil
+	}
+
+	gcm, err := newCacheGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("minfs: cache file too short to contain a nonce")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newCacheGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cacheAllocate reserves a new local cache file for resourceKey, guarded
+// by mfs.km so that overlapping Flushes of the same resource don't race
+// between allocation and the first cacheSave.
+func (mfs *MinFS) cacheAllocate(resourceKey string) (cachePath string, unlock func(), err error) {
+	unlock = mfs.km.Lock(resourceKey)
+
+	cachePath, err = mfs.NewCachePath()
+	if err != nil {
+		unlock()
+		return "", nil, err
+	}
+
+	return cachePath, unlock, nil
+}
+
+// cacheSave writes data to cachePath, encrypting it at rest when SSE-C is
+// configured so plaintext is never persisted to the cache directory.
+func (mfs *MinFS) cacheSave(cachePath string, data []byte) error {
+	out, err := mfs.encryptCacheBytes(data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cachePath, out, 0600)
+}
+
+// cacheLoad reads cachePath back, decrypting it when SSE-C is configured.
+func (mfs *MinFS) cacheLoad(cachePath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	return mfs.decryptCacheBytes(data)
+}
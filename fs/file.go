@@ -0,0 +1,334 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// File represents a single object inside a backend's bucket.
+type File struct {
+	dir *Dir
+	mfs *MinFS
+
+	Backend string
+	Path    string
+
+	// Ino is the stable iNode assigned to Backend+Path by
+	// MinFS.inodeFor, and the key f's chunk manifest is stored under.
+	Ino uint64
+
+	UID  uint32
+	GID  uint32
+	Mode os.FileMode
+	Size uint64
+}
+
+// resourceKey identifies f for the cache index, sync journal and
+// KeyedMutex. It is prefixed with the backend name so that federated
+// backends can never collide over the same object key.
+func (f *File) resourceKey() string {
+	return f.Backend + "/" + f.Path
+}
+
+// Attr implements fs.Node.
+func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = f.Ino
+	a.Mode = f.Mode
+	a.Uid = f.UID
+	a.Gid = f.GID
+	a.Size = f.Size
+	return nil
+}
+
+// Open implements fs.NodeOpener. It neither fetches nor chunks any object
+// data itself -- that is deferred to the first readRange call against the
+// resulting handle (see ensureManifest) -- so a plain open/close (a stat
+// through some tools, or a WebDAV directory listing) never pays for a
+// download that nothing ends up reading.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	f.mfs.opCounters.inc("fileopen")
+
+	if err := f.mfs.WaitForCacheSpace(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := f.mfs.touchCacheIndex(f.resourceKey(), f.Ino); err != nil {
+		f.mfs.log.Println("cache: unable to update access index for", f.resourceKey(), err)
+	}
+
+	return f.mfs.Acquire(f, f.resourceKey())
+}
+
+// ensureManifest returns f's chunk manifest, building it on demand the
+// first time any read actually needs it. Concurrent callers for the same
+// iNode are serialized through KeyedMutex so two readers racing on a
+// freshly-opened file only build the manifest once.
+//
+// Building it still means downloading the whole object: content-defined
+// chunk boundaries are a function of the data itself (see splitChunks), so
+// they can only be discovered by scanning it, and ranged GetObject can't
+// help until a manifest already says where the chunks fall. The saving
+// this buys is therefore cross-version and cross-open, not first-read --
+// once a manifest exists, re-opens of this file and first-opens of any
+// other file with identical content reuse whatever chunks already hashed
+// onto disk instead of re-downloading them.
+func (f *File) ensureManifest(ctx context.Context) ([]chunkSpan, error) {
+	if spans, err := f.mfs.getManifest(f.Ino); err == nil {
+		f.mfs.recordCacheHit()
+		return spans, nil
+	} else if err != errNoManifest {
+		return nil, err
+	}
+
+	unlock := f.mfs.km.Lock(f.resourceKey())
+	defer unlock()
+
+	// Another goroutine may have built it while we waited for the lock.
+	if spans, err := f.mfs.getManifest(f.Ino); err == nil {
+		f.mfs.recordCacheHit()
+		return spans, nil
+	} else if err != errNoManifest {
+		return nil, err
+	}
+
+	f.mfs.recordCacheMiss()
+	if err := f.buildManifest(ctx); err != nil {
+		return nil, err
+	}
+	return f.mfs.getManifest(f.Ino)
+}
+
+// buildManifest downloads f's full object once (decrypting it if SSE-C is
+// configured) and splits it into content-defined chunks via
+// rechunkAndStore. See ensureManifest for why this can't be avoided on the
+// object's first read.
+func (f *File) buildManifest(ctx context.Context) error {
+	api, err := f.mfs.getApi(f.Backend)
+	if err != nil {
+		return err
+	}
+
+	b, err := f.mfs.backend(f.Backend)
+	if err != nil {
+		return err
+	}
+
+	sse, err := f.mfs.serverSide()
+	if err != nil {
+		return err
+	}
+
+	obj, err := api.GetObject(ctx, b.Bucket, f.Path, minio.GetObjectOptions{ServerSideEncryption: sse})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	data, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.mfs.rechunkAndStore(f.Ino, data)
+	return err
+}
+
+// readRange returns f's bytes in [offset, offset+size), resolving its
+// chunk manifest and fetching only the chunks overlapping the range that
+// aren't already cached locally.
+func (f *File) readRange(ctx context.Context, offset, size int64) ([]byte, error) {
+	if offset >= int64(f.Size) {
+		return nil, nil
+	}
+
+	end := offset + size
+	if end > int64(f.Size) {
+		end = int64(f.Size)
+	}
+
+	manifest, err := f.ensureManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, span := range spansInRange(manifest, offset, end-offset) {
+		data, err := f.mfs.loadChunk(ctx, f.Backend, f.Path, span)
+		if err != nil {
+			return nil, err
+		}
+
+		lo := int64(0)
+		if span.Offset < offset {
+			lo = offset - span.Offset
+		}
+		hi := span.Length
+		if span.Offset+span.Length > end {
+			hi = end - span.Offset
+		}
+
+		out = append(out, data[lo:hi]...)
+	}
+
+	return out, nil
+}
+
+// FileHandle represents an open handle to a File, created by Open via
+// MinFS.Acquire. Reads are served chunk-by-chunk straight from
+// File.readRange until the first Write, at which point the whole object is
+// buffered in memory so in-place edits are simple; Flush re-chunks the
+// buffer and rewrites the manifest.
+type FileHandle struct {
+	f *File
+
+	handle uint64
+
+	mu    sync.Mutex
+	dirty bool
+	buf   []byte
+}
+
+// Read implements fs.HandleReader.
+func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	fh.f.mfs.opCounters.inc("read")
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if !fh.dirty {
+		data, err := fh.f.readRange(ctx, req.Offset, int64(req.Size))
+		if err != nil {
+			return err
+		}
+		resp.Data = data
+		return nil
+	}
+
+	if req.Offset >= int64(len(fh.buf)) {
+		resp.Data = nil
+		return nil
+	}
+
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(fh.buf)) {
+		end = int64(len(fh.buf))
+	}
+
+	resp.Data = append([]byte(nil), fh.buf[req.Offset:end]...)
+	return nil
+}
+
+// Write implements fs.HandleWriter. The first write against a handle
+// pulls the current object fully into memory (via readRange, so it still
+// benefits from whatever chunks are already cached); subsequent writes
+// mutate that buffer in place. Nothing is uploaded until Flush.
+func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	fh.f.mfs.opCounters.inc("write")
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if !fh.dirty {
+		full, err := fh.f.readRange(ctx, 0, int64(fh.f.Size))
+		if err != nil {
+			return err
+		}
+		fh.buf = full
+		fh.dirty = true
+	}
+
+	end := req.Offset + int64(len(req.Data))
+	if end > int64(len(fh.buf)) {
+		grown := make([]byte, end)
+		copy(grown, fh.buf)
+		fh.buf = grown
+	}
+	copy(fh.buf[req.Offset:end], req.Data)
+
+	if end > int64(fh.f.Size) {
+		fh.f.Size = uint64(end)
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Flush implements fs.HandleFlusher. A dirty handle is re-chunked via
+// rechunkAndStore: regions untouched by the edit hash identically to what
+// is already cached and are not rewritten, so only the chunks touching the
+// edit are new. The reassembled object is then enqueued on the write-back
+// sync pipeline as a single PutOperation. Uploading only the changed
+// chunks via S3 multipart, rather than the whole reassembled object, is
+// left for follow-up work; what Flush already gives is a local chunk
+// cache and manifest that stay deduplicated across edits, files and
+// versions.
+func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	fh.f.mfs.opCounters.inc("flush")
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if !fh.dirty {
+		return nil
+	}
+
+	if _, err := fh.f.mfs.rechunkAndStore(fh.f.Ino, fh.buf); err != nil {
+		return err
+	}
+
+	cachePath, unlock, err := fh.f.mfs.cacheAllocate(fh.f.resourceKey())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := fh.f.mfs.cacheSave(cachePath, fh.buf); err != nil {
+		return err
+	}
+
+	// Track the staging copy against quota, and mark it dirty so eviction
+	// leaves it alone until putOp has uploaded it and removed it (see
+	// sync.go); otherwise it sits on disk untracked and unreclaimed for
+	// as long as the mount runs.
+	if err := fh.f.mfs.updateCacheSize(fh.f.resourceKey(), cachePath, int64(len(fh.buf)), true); err != nil {
+		return err
+	}
+
+	if err := fh.f.mfs.Sync(&PutOperation{
+		Backend:   fh.f.Backend,
+		Path:      fh.f.Path,
+		CachePath: cachePath,
+	}); err != nil {
+		return err
+	}
+
+	fh.dirty = false
+	return nil
+}
+
+// Release implements fs.HandleReleaser.
+func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return fh.f.mfs.Release(fh)
+}
@@ -19,6 +19,7 @@ package minfs
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
@@ -30,12 +31,14 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/minio/minfs/fs/gateway"
 	"github.com/minio/minfs/meta"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"golang.org/x/net/webdav"
 )
 
 var (
@@ -48,7 +51,7 @@ type KeyedMutex struct {
 	mutexes sync.Map // Zero value is empty and ready for use
 }
 
-// This lets us lock resources via a key (we'll use it to lock overlapping Open requests to prevent data-race condition between cacheAllocate and cacheSave)
+// This lets us lock resources via a key (we'll use it to lock overlapping Flush requests to prevent data-race condition between cacheAllocate and cacheSave, and to lock per content-addressed chunk hash during loadChunk so two readers racing on the same chunk only fetch it once)
 func (m *KeyedMutex) Lock(key string) func() {
 	value, _ := m.mutexes.LoadOrStore(key, &sync.Mutex{})
 	mtx := value.(*sync.Mutex)
@@ -60,7 +63,11 @@ func (m *KeyedMutex) Lock(key string) func() {
 // MinFS contains the meta data for the MinFS client
 type MinFS struct {
 	config *Config
-	api    *minio.Client
+
+	// apis caches one *minio.Client per federated backend, built lazily
+	// by getApi and protected by apisMu.
+	apis   map[string]*minio.Client
+	apisMu sync.Mutex
 
 	db *meta.DB
 
@@ -79,12 +86,33 @@ type MinFS struct {
 	// Global openfd map lock
 	m sync.Mutex
 
-	syncChan chan interface{}
+	syncChan chan *syncJob
+
+	// syncMetrics tracks the write-back sync pipeline's pending
+	// operations, bytes in flight and retry count, surfaced via
+	// SyncStats() for the status/metrics endpoint.
+	syncMetrics syncMetrics
+
+	// cache tracks on-disk cache usage against cfg.quota and lets Open
+	// callers block for space via WaitForCacheSpace.
+	cache *cacheState
+
+	// cacheMetrics tracks cache hits, misses, evictions and bytes
+	// reclaimed, surfaced via CacheStats().
+	cacheMetrics cacheMetrics
 
 	listenerDoneCh chan struct{}
 
 	// Keyed cache resource lock
 	km KeyedMutex
+
+	// opCounters tallies FUSE operations by name for the /metrics
+	// endpoint's minfs_fuse_ops_total counter.
+	opCounters *opCounters
+
+	// s3Latency histograms the latency of every S3 request made through
+	// getApi's http.Transport, for the /metrics endpoint.
+	s3Latency *latencyHistogram
 }
 
 // New will return a new MinFS client
@@ -103,15 +131,18 @@ func New(options ...func(*Config)) (*MinFS, error) {
 
 	// Set defaults
 	cfg := &Config{
-		cache:     globalDBDir,
-		quota:     globalQuota,
-		basePath:  "",
-		accountID: fmt.Sprintf("%d", time.Now().UTC().Unix()),
-		gid:       0,
-		uid:       0,
-		accessKey: ac.AccessKey,
-		secretKey: ac.SecretKey,
-		mode:      os.FileMode(0444),
+		cache:       globalDBDir,
+		quota:       globalQuota,
+		basePath:    "",
+		accountID:   fmt.Sprintf("%d", time.Now().UTC().Unix()),
+		gid:         0,
+		uid:         0,
+		accessKey:   ac.AccessKey,
+		secretKey:   ac.SecretKey,
+		mode:        os.FileMode(0444),
+		serveMode:   ServeModeFUSE,
+		commitMode:  CommitWriteback,
+		cachePolicy: LRU(),
 	}
 
 	for _, optionFn := range options {
@@ -130,11 +161,15 @@ func New(options ...func(*Config)) (*MinFS, error) {
 	// Initialize MinFS.
 	fs := &MinFS{
 		config:         cfg,
-		syncChan:       make(chan interface{}),
+		apis:           map[string]*minio.Client{},
+		syncChan:       make(chan *syncJob, syncChanBufferSize),
 		locks:          map[string]bool{},
 		openfds:        map[uint64]string{},
 		log:            log.New(logW, "MinFS ", log.Ldate|log.Ltime|log.Lshortfile),
 		listenerDoneCh: make(chan struct{}),
+		cache:          newCacheState(),
+		opCounters:     newOpCounters(),
+		s3Latency:      newLatencyHistogram(),
 	}
 
 	// Success..
@@ -151,15 +186,25 @@ func (mfs *MinFS) mount() (*fuse.Conn, error) {
 	)
 }
 
-func (mfs *MinFS) getApi(uid uint32) (api *minio.Client, err error) {
+// getApi returns the *minio.Client for backend, building and caching one
+// on first use.
+func (mfs *MinFS) getApi(backend string) (api *minio.Client, err error) {
+	mfs.apisMu.Lock()
+	defer mfs.apisMu.Unlock()
 
-	var (
-		host   = mfs.config.target.Host
-		access = mfs.config.accessKey
-		secret = mfs.config.secretKey
-		token  = mfs.config.secretToken
-		secure = mfs.config.target.Scheme == "https"
-	)
+	if api, ok := mfs.apis[backend]; ok {
+		return api, nil
+	}
+
+	b, err := mfs.backend(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := b.url()
+	if err != nil {
+		return nil, err
+	}
 
 	var transport http.RoundTripper = &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -172,7 +217,7 @@ func (mfs *MinFS) getApi(uid uint32) (api *minio.Client, err error) {
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: false,
+			InsecureSkipVerify: b.Insecure,
 		},
 		// Set this value so that the underlying transport round-tripper
 		// doesn't try to auto decode the body of objects with
@@ -182,20 +227,75 @@ func (mfs *MinFS) getApi(uid uint32) (api *minio.Client, err error) {
 		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
 		DisableCompression: true,
 	}
+	transport = &instrumentedTransport{next: transport, hist: mfs.s3Latency}
 
-	creds := credentials.NewStaticV4(access, secret, token)
 	options := &minio.Options{
-		Creds:     creds,
-		Secure:    secure,
+		Creds:     mfs.credentials(b),
+		Secure:    target.Scheme == "https",
 		Transport: transport,
 	}
 
-	api, err = minio.New(host, options)
+	api, err = minio.New(target.Host, options)
+	if err != nil {
+		return nil, err
+	}
+
+	mfs.apis[backend] = api
+	return api, nil
+}
+
+// backend looks up a configured Backend by name.
+func (mfs *MinFS) backend(name string) (Backend, error) {
+	for _, b := range mfs.config.targets {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return Backend{}, fmt.Errorf("minfs: unknown backend %q", name)
+}
+
+// backendIndex returns b's position within Config.targets, used by
+// NextSequence to partition iNodes per backend.
+func (mfs *MinFS) backendIndex(name string) (int, error) {
+	for i, b := range mfs.config.targets {
+		if b.Name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("minfs: unknown backend %q", name)
+}
+
+// minioBucket returns the meta.DB bucket name holding backend's iNode
+// sequence counter.
+func minioBucket(backend string) []byte {
+	return []byte("minio/" + backend + "/")
+}
+
+// credentials returns the credentials.Credentials used to authenticate
+// against b. A per-backend CredentialsProvider takes precedence, followed
+// by the mount-wide one (LDAP, STS web-identity, IAM instance
+// credentials, ...), wrapped so that it is re-retrieved on-demand,
+// allowing long running mounts to survive credential rotation. Lacking
+// either, it falls back to b's static accessKey/secretKey/secretToken, and
+// then to the mount-wide ones from Config.
+func (mfs *MinFS) credentials(b Backend) *credentials.Credentials {
+	if b.credsProvider != nil {
+		return credentials.New(b.credsProvider)
+	}
+	if mfs.config.credsProvider != nil {
+		return credentials.New(mfs.config.credsProvider)
+	}
+
+	accessKey, secretKey, secretToken := b.AccessKey, b.SecretKey, b.SecretToken
+	if accessKey == "" || secretKey == "" {
+		accessKey, secretKey, secretToken = mfs.config.accessKey, mfs.config.secretKey, mfs.config.secretToken
+	}
 
-	return api, err
+	return credentials.New(NewStaticCredentialsProvider(accessKey, secretKey, secretToken))
 }
 
-// Serve starts the MinFS client
+// Serve starts the MinFS client. Depending on Config.serveMode it exposes
+// the tree via FUSE, WebDAV, or both at once.
 func (mfs *MinFS) Serve() (err error) {
 	if mfs.config.debug {
 		fuse.Debug = func(msg interface{}) {
@@ -203,16 +303,10 @@ func (mfs *MinFS) Serve() (err error) {
 		}
 	}
 
-	defer mfs.shutdown()
-
-	// mount the drive
-	var c *fuse.Conn
-	c, err = mfs.mount()
-	if err != nil {
-		return err
-	}
+	serveFUSE := mfs.config.serveMode == ServeModeFUSE || mfs.config.serveMode == ServeModeBoth
+	serveWebDAV := mfs.config.serveMode == ServeModeWebDAV || mfs.config.serveMode == ServeModeBoth
 
-	defer c.Close()
+	defer mfs.shutdown()
 
 	// channel to receive errors
 	trapChannel := signalTrap(os.Interrupt, syscall.SIGTERM, os.Kill)
@@ -236,60 +330,57 @@ func (mfs *MinFS) Serve() (err error) {
 
 	mfs.log.Println("Initializing cache database")
 	if err = mfs.db.Update(func(tx *meta.Tx) error {
-		_, berr := tx.CreateBucketIfNotExists([]byte("minio/"))
-		return berr
+		for _, b := range mfs.config.targets {
+			if _, berr := tx.CreateBucketIfNotExists(minioBucket(b.Name)); berr != nil {
+				return berr
+			}
+		}
+		return nil
 	}); err != nil {
 		return err
 	}
 
-	mfs.log.Println("Initializing minio client:")
-	var (
-		host   = mfs.config.target.Host
-		access = mfs.config.accessKey
-		secret = mfs.config.secretKey
-		token  = mfs.config.secretToken
-		secure = mfs.config.target.Scheme == "https"
-	)
-
 	go mfs.MonitorCache()
 
-	var transport http.RoundTripper = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: mfs.config.insecure,
-		},
-		// Set this value so that the underlying transport round-tripper
-		// doesn't try to auto decode the body of objects with
-		// content-encoding set to `gzip`.
-		//
-		// Refer:
-		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
-		DisableCompression: true,
+	mfs.log.Println("Initializing minio client(s):")
+	for _, b := range mfs.config.targets {
+		if _, err = mfs.getApi(b.Name); err != nil {
+			return err
+		}
 	}
 
-	creds := credentials.NewStaticV4(access, secret, token)
-	options := &minio.Options{
-		Creds:     creds,
-		Secure:    secure,
-		Transport: transport,
+	if err = mfs.startSync(); err != nil {
+		return err
 	}
 
-	mfs.api, err = minio.New(host, options)
-	if err != nil {
+	// Replay any sync journal entries left behind by a previous crash
+	// before opening the FUSE connection, so in-flight writes are not
+	// lost and the tree the kernel sees is consistent with the bucket.
+	mfs.log.Println("Replaying outstanding sync journal entries")
+	if err = mfs.replaySync(); err != nil {
 		return err
 	}
 
-	if err = mfs.startSync(); err != nil {
+	if serveWebDAV {
+		go mfs.serveWebDAV()
+	}
+
+	if mfs.config.adminAddr != "" {
+		go mfs.serveAdmin()
+	}
+
+	if !serveFUSE {
+		<-mfs.listenerDoneCh
+		return nil
+	}
+
+	// mount the drive
+	var c *fuse.Conn
+	c, err = mfs.mount()
+	if err != nil {
 		return err
 	}
+	defer c.Close()
 
 	mfs.log.Println("Serving... Have fun!")
 	// Serve the filesystem
@@ -304,52 +395,49 @@ func (mfs *MinFS) Serve() (err error) {
 	return c.MountError
 }
 
-func (mfs *MinFS) shutdown() {
-	mfs.log.Println("Shutting down")
-
-	if err := fuse.Unmount(mfs.config.mountpoint); err != nil {
-		mfs.log.Println("Some error (possibly ok) while umounting", mfs.config.mountpoint, err)
+// serveWebDAV runs the WebDAV gateway, adapting mfs's FUSE node tree via
+// gateway.New so WebDAV requests are served through the same Dir/File
+// implementation and meta.DB cache as the FUSE mount. The gateway is
+// read-only: it rejects writes, so nothing it serves reaches the sync
+// pipeline.
+func (mfs *MinFS) serveWebDAV() {
+	defer close(mfs.listenerDoneCh)
+
+	addr := mfs.config.webdavAddr
+	if addr == "" {
+		addr = ":8765"
 	}
 
-}
+	mfs.log.Println("Serving WebDAV on", addr)
 
-func (mfs *MinFS) sync(req interface{}) error {
-	mfs.syncChan <- req
-	return nil
-}
+	handler := &webdav.Handler{
+		FileSystem: gateway.New(mfs),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				mfs.log.Println("WebDAV", r.Method, r.URL.Path, err)
+			}
+		},
+	}
 
-func (mfs *MinFS) moveOp(req *MoveOperation) {
-	fmt.Println("moveOp() removed")
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		mfs.log.Println("WebDAV server exited:", err)
+	}
 }
 
-func (mfs *MinFS) copyOp(req *CopyOperation) {
-	fmt.Println("copyOp() removed")
-}
+func (mfs *MinFS) shutdown() {
+	mfs.log.Println("Shutting down")
 
-func (mfs *MinFS) putOp(req *PutOperation) {
-	fmt.Println("putOp() removed")
-}
+	if err := fuse.Unmount(mfs.config.mountpoint); err != nil {
+		mfs.log.Println("Some error (possibly ok) while umounting", mfs.config.mountpoint, err)
+	}
 
-func (mfs *MinFS) startSync() error {
-	go func() {
-		for req := range mfs.syncChan {
-			switch req := req.(type) {
-			case *MoveOperation:
-				mfs.moveOp(req)
-			case *CopyOperation:
-				mfs.copyOp(req)
-			case *PutOperation:
-				mfs.putOp(req)
-			default:
-				panic("Unknown type")
-			}
-		}
-	}()
-	return nil
 }
 
 // Statfs will return meta information on the minio filesystem
 func (mfs *MinFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	mfs.opCounters.inc("statfs")
+
 	resp.Blocks = 0x1000000000
 	resp.Bfree = 0x1000000000
 	resp.Bavail = 0x1000000000
@@ -360,6 +448,7 @@ func (mfs *MinFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fus
 
 // Acquire will return a new FileHandle, adds to openfd map
 func (mfs *MinFS) Acquire(f *File, resourceKey string) (*FileHandle, error) {
+	mfs.opCounters.inc("open")
 
 	fh := &FileHandle{
 		f: f,
@@ -373,36 +462,107 @@ func (mfs *MinFS) Acquire(f *File, resourceKey string) (*FileHandle, error) {
 	mfs.openfds[fh.handle] = resourceKey
 	mfs.m.Unlock()
 
+	if err := mfs.touchCacheIndex(resourceKey, f.Ino); err != nil {
+		mfs.log.Println("cache: unable to update access index for", resourceKey, err)
+	}
+
 	return fh, nil
 }
 
 // Release release the filehandle, removes from openfd map
 func (mfs *MinFS) Release(fh *FileHandle) error {
+	mfs.opCounters.inc("release")
 
 	mfs.m.Lock()
+	resourceKey := mfs.openfds[fh.handle]
 	delete(mfs.openfds, fh.handle)
 	mfs.m.Unlock()
 
+	if err := mfs.touchCacheIndex(resourceKey, fh.f.Ino); err != nil {
+		mfs.log.Println("cache: unable to update access index for", resourceKey, err)
+	}
+
 	return nil
 }
 
-// NextSequence will return the next free iNode
-func (mfs *MinFS) NextSequence(tx *meta.Tx) (sequence uint64, err error) {
-	bucket := tx.Bucket("minio/")
-	return bucket.NextSequence()
+// NextSequence returns the next free iNode for backend. The backend's
+// index within Config.targets occupies the high 16 bits so that iNodes
+// minted for different backends can never collide, even though each
+// backend keeps its own independent sequence counter bucket.
+func (mfs *MinFS) NextSequence(tx *meta.Tx, backend string) (sequence uint64, err error) {
+	idx, err := mfs.backendIndex(backend)
+	if err != nil {
+		return 0, err
+	}
+
+	bucket, err := tx.CreateBucketIfNotExists(minioBucket(backend))
+	if err != nil {
+		return 0, err
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(idx)<<48 | (seq & 0xFFFFFFFFFFFF), nil
+}
+
+// inodeBucket is the meta.DB bucket mapping a backend's object paths to
+// the stable iNode assigned to them.
+func inodeBucket(backend string) []byte {
+	return []byte("inodes/" + backend + "/")
 }
 
-// Root is the root folder of the MinFS mountpoint
+// inodeFor returns the stable iNode for objPath within backend, assigning
+// and persisting a new one (via NextSequence) the first time objPath is
+// looked up. A stable, persistent iNode is what lets a file's chunk
+// manifest (keyed by iNode, see chunk.go) be found again on a later
+// Lookup of the same path.
+func (mfs *MinFS) inodeFor(backend, objPath string) (ino uint64, err error) {
+	err = mfs.db.Update(func(tx *meta.Tx) error {
+		bucket, berr := tx.CreateBucketIfNotExists(inodeBucket(backend))
+		if berr != nil {
+			return berr
+		}
+
+		if v := bucket.Get([]byte(objPath)); v != nil {
+			ino = binary.BigEndian.Uint64(v)
+			return nil
+		}
+
+		seq, serr := mfs.NextSequence(tx, backend)
+		if serr != nil {
+			return serr
+		}
+		ino = seq
+
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, ino)
+		return bucket.Put([]byte(objPath), buf)
+	})
+	return ino, err
+}
+
+// Root is the root folder of the MinFS mountpoint. With a single backend
+// configured it is that backend's bucket root, preserving pre-federation
+// behaviour; with more than one, it is the synthetic federation root that
+// lists each backend by name.
 func (mfs *MinFS) Root() (fs.Node, error) {
-	return &Dir{
-		dir:  nil,
+	root := &Dir{
 		mfs:  mfs,
 		Path: "",
 
 		UID:  mfs.config.uid,
 		GID:  mfs.config.gid,
 		Mode: os.ModeDir | 0750,
-	}, nil
+	}
+
+	if len(mfs.config.targets) == 1 {
+		root.Backend = mfs.config.targets[0].Name
+	}
+
+	return root, nil
 }
 
 // Storer -
@@ -0,0 +1,139 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gateway
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+// file adapts a fusefs.Handle to webdav.File (and the embedded http.File),
+// so range reads made by WebDAV clients go through the same Open/Read path
+// the FUSE mount uses.
+type file struct {
+	ctx    context.Context
+	node   fusefs.Node
+	handle fusefs.Handle
+	name   string
+	offset int64
+}
+
+// Read implements io.Reader by issuing a fusefs.HandleReader.Read at the
+// current offset, the same call a FUSE read request would make.
+func (f *file) Read(p []byte) (int, error) {
+	reader, ok := f.handle.(fusefs.HandleReader)
+	if !ok {
+		return 0, os.ErrInvalid
+	}
+
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, len(p))}
+	if err := reader.Read(f.ctx, &fuse.ReadRequest{Offset: f.offset, Size: len(p)}, resp); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, resp.Data)
+	f.offset += int64(n)
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Write implements webdav.File. The gateway mounts read-only, so writes
+// are rejected here; FileSystem.OpenFile never hands out a writable file
+// handle in the first place.
+func (f *file) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Seek implements io.Seeker.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	var attr fuse.Attr
+	switch whence {
+	case io.SeekStart:
+		f.offset = offset
+	case io.SeekCurrent:
+		f.offset += offset
+	case io.SeekEnd:
+		if err := f.node.Attr(f.ctx, &attr); err != nil {
+			return 0, err
+		}
+		f.offset = int64(attr.Size) + offset
+	default:
+		return 0, os.ErrInvalid
+	}
+	return f.offset, nil
+}
+
+// Readdir implements http.File by listing the wrapped directory node via
+// fusefs.HandleReadDirAller, the same call FUSE uses to serve readdir(2).
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	lister, ok := f.handle.(fusefs.HandleReadDirAller)
+	if !ok {
+		return nil, os.ErrInvalid
+	}
+
+	dirents, err := lister.ReadDirAll(f.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > 0 && count < len(dirents) {
+		dirents = dirents[:count]
+	}
+
+	infos := make([]os.FileInfo, 0, len(dirents))
+	for _, d := range dirents {
+		infos = append(infos, &fileInfo{
+			name: d.Name,
+			attr: fuse.Attr{Mode: direntMode(d.Type)},
+		})
+	}
+	return infos, nil
+}
+
+func direntMode(t fuse.DirentType) os.FileMode {
+	if t == fuse.DT_Dir {
+		return os.ModeDir | 0550
+	}
+	return 0440
+}
+
+// Stat implements http.File.
+func (f *file) Stat() (os.FileInfo, error) {
+	var attr fuse.Attr
+	if err := f.node.Attr(f.ctx, &attr); err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: f.name, attr: attr}, nil
+}
+
+// Close implements io.Closer by issuing a fusefs.HandleReleaser.Release,
+// the same call a FUSE release request would make, so the handle is
+// removed from the open file descriptor map instead of leaking there for
+// the lifetime of the mount.
+func (f *file) Close() error {
+	releaser, ok := f.handle.(fusefs.HandleReleaser)
+	if !ok {
+		return nil
+	}
+	return releaser.Release(f.ctx, &fuse.ReleaseRequest{})
+}
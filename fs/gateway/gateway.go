@@ -0,0 +1,176 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package gateway adapts a MinFS FUSE node tree to golang.org/x/net/webdav,
+// so the same Dir/File implementation -- and therefore the same meta.DB
+// cache and KeyedMutex bookkeeping -- can be served read-only over WebDAV
+// on hosts where FUSE is unavailable (containers without /dev/fuse,
+// Windows, macOS without osxfuse). Writes are rejected and never reach
+// MinFS's sync pipeline.
+package gateway
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"golang.org/x/net/webdav"
+)
+
+// FileSystem adapts a fusefs.FS (such as *minfs.MinFS) to webdav.FileSystem.
+// The gateway is read-only: writes (OpenFile for write, Mkdir, RemoveAll,
+// Rename) all return os.ErrPermission, matching the read-only default
+// Config.mode MinFS mounts with. Routing writes through MinFS's sync
+// pipeline is left for follow-up work.
+type FileSystem struct {
+	fs fusefs.FS
+}
+
+// New returns a webdav.FileSystem backed by fsys.
+func New(fsys fusefs.FS) *FileSystem {
+	return &FileSystem{fs: fsys}
+}
+
+// lookup walks name ("/"-separated) down the node tree via
+// fusefs.NodeStringLookuper, the same interface bazil's FUSE server itself
+// uses to resolve path components.
+func (f *FileSystem) lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	node, err := f.fs.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range splitPath(name) {
+		lookuper, ok := node.(fusefs.NodeStringLookuper)
+		if !ok {
+			return nil, os.ErrInvalid
+		}
+
+		node, err = lookuper.Lookup(ctx, part)
+		if err != nil {
+			return nil, toOSError(err)
+		}
+	}
+
+	return node, nil
+}
+
+func splitPath(name string) []string {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func toOSError(err error) error {
+	if err == fuse.ENOENT {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// Stat implements webdav.FileSystem.
+func (f *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	node, err := f.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var attr fuse.Attr
+	if err := node.Attr(ctx, &attr); err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: baseName(name), attr: attr}, nil
+}
+
+// OpenFile implements webdav.FileSystem. Existing files are opened
+// read-only through the node's fusefs.NodeOpener/HandleReader, matching the
+// read path the FUSE mount uses; writes are not yet supported through the
+// gateway and return os.ErrPermission, mirroring the read-only default
+// Config.mode MinFS mounts with.
+//
+// *minfs.Dir has no NodeOpener -- unlike *minfs.File, it is its own
+// fusefs.Handle, serving ReadDirAll directly without an Open step -- so a
+// directory node is handed to file as its own handle instead. webdav's
+// PROPFIND support (walkFS) relies on this: it lists a collection by
+// calling OpenFile(name, O_RDONLY) followed by Readdir.
+func (f *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	node, err := f.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if opener, ok := node.(fusefs.NodeOpener); ok {
+		handle, err := opener.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			return nil, toOSError(err)
+		}
+		return &file{ctx: ctx, node: node, handle: handle, name: baseName(name)}, nil
+	}
+
+	if _, ok := node.(fusefs.HandleReadDirAller); ok {
+		return &file{ctx: ctx, node: node, handle: node, name: baseName(name)}, nil
+	}
+
+	return nil, os.ErrInvalid
+}
+
+// Mkdir implements webdav.FileSystem. MinFS mounts are read-only by
+// default (see Config.mode), so directory creation through the gateway is
+// not yet supported.
+func (f *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+// RemoveAll implements webdav.FileSystem. Not yet supported -- see Mkdir.
+func (f *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+// Rename implements webdav.FileSystem. Not yet supported -- see Mkdir.
+func (f *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// fileInfo adapts a fuse.Attr to os.FileInfo.
+type fileInfo struct {
+	name string
+	attr fuse.Attr
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.attr.Size) }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.attr.Mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.attr.Mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.attr.Mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return &fi.attr }
+
+func baseName(name string) string {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return "/"
+	}
+	return parts[len(parts)-1]
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// opCounters tallies FUSE operations by name (lookup, readdirall, open,
+// read, write, flush, release, statfs, ...) for the fuse_ops_total metric.
+type opCounters struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newOpCounters() *opCounters {
+	return &opCounters{counts: map[string]int64{}}
+}
+
+// inc increments name's counter. Called at the top of the FUSE-facing
+// methods of MinFS, Dir, File and FileHandle other than Attr, and by
+// applyWithRetry as "sync" for each journal entry a sync worker applies.
+func (o *opCounters) inc(name string) {
+	o.mu.Lock()
+	o.counts[name]++
+	o.mu.Unlock()
+}
+
+// snapshot returns a copy of the current counts, sorted by name for
+// deterministic /metrics output.
+func (o *opCounters) snapshot() []struct {
+	Name  string
+	Count int64
+} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := make([]struct {
+		Name  string
+		Count int64
+	}, 0, len(o.counts))
+	for name, count := range o.counts {
+		out = append(out, struct {
+			Name  string
+			Count int64
+		}{name, count})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// latencyBuckets are the histogram bucket upper bounds (seconds) used for
+// the S3 request latency histogram, matching Prometheus's own default
+// buckets.
+var latencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// latencyHistogram is a minimal Prometheus-style histogram: a fixed set of
+// cumulative "le" buckets plus a running sum and count, all updated with
+// atomics so Observe can be called from concurrent RoundTrips without a
+// lock.
+type latencyHistogram struct {
+	buckets []int64 // counts, one per latencyBuckets entry, cumulative as observe records them
+	sum     uint64  // math.Float64bits of the running sum of observed seconds
+	count   int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]int64, len(latencyBuckets))}
+}
+
+// observe records a single duration, in seconds, against the histogram.
+func (h *latencyHistogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			atomic.AddInt64(&h.buckets[i], 1)
+		}
+	}
+	atomic.AddInt64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		next := math.Float64bits(math.Float64frombits(old) + seconds)
+		if atomic.CompareAndSwapUint64(&h.sum, old, next) {
+			return
+		}
+	}
+}
+
+// writeProm writes h in Prometheus text exposition format under name.
+func (h *latencyHistogram) writeProm(w *strings.Builder, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, "S3 request latency in seconds")
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), atomic.LoadInt64(&h.buckets[i]))
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, atomic.LoadInt64(&h.count))
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum)), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, atomic.LoadInt64(&h.count))
+}
+
+// instrumentedTransport wraps an http.RoundTripper, recording every S3
+// request's latency into hist.
+type instrumentedTransport struct {
+	next http.RoundTripper
+	hist *latencyHistogram
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	t.hist.observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// metricsText renders mfs's current state in Prometheus text exposition
+// format, for the admin server's /metrics endpoint.
+func (mfs *MinFS) metricsText() string {
+	var w strings.Builder
+
+	mfs.m.Lock()
+	openHandles := len(mfs.openfds)
+	mfs.m.Unlock()
+
+	fmt.Fprintln(&w, "# HELP minfs_open_handles Number of currently open FUSE file handles")
+	fmt.Fprintln(&w, "# TYPE minfs_open_handles gauge")
+	fmt.Fprintf(&w, "minfs_open_handles %d\n", openHandles)
+
+	fmt.Fprintln(&w, "# HELP minfs_handles_opened_total Cumulative number of FUSE file handles ever opened")
+	fmt.Fprintln(&w, "# TYPE minfs_handles_opened_total counter")
+	fmt.Fprintf(&w, "minfs_handles_opened_total %d\n", atomic.LoadUint64(&mfs.fdcounter))
+
+	cacheStats := mfs.CacheStats()
+	fmt.Fprintln(&w, "# HELP minfs_cache_used_bytes Local on-disk cache bytes currently in use")
+	fmt.Fprintln(&w, "# TYPE minfs_cache_used_bytes gauge")
+	fmt.Fprintf(&w, "minfs_cache_used_bytes %d\n", cacheStats.UsedBytes)
+
+	fmt.Fprintln(&w, "# HELP minfs_cache_quota_bytes Configured cache quota in bytes, 0 if unbounded")
+	fmt.Fprintln(&w, "# TYPE minfs_cache_quota_bytes gauge")
+	fmt.Fprintf(&w, "minfs_cache_quota_bytes %d\n", mfs.config.quota)
+
+	fmt.Fprintln(&w, "# HELP minfs_cache_hits_total Cache hits")
+	fmt.Fprintln(&w, "# TYPE minfs_cache_hits_total counter")
+	fmt.Fprintf(&w, "minfs_cache_hits_total %d\n", cacheStats.Hits)
+
+	fmt.Fprintln(&w, "# HELP minfs_cache_misses_total Cache misses")
+	fmt.Fprintln(&w, "# TYPE minfs_cache_misses_total counter")
+	fmt.Fprintf(&w, "minfs_cache_misses_total %d\n", cacheStats.Misses)
+
+	fmt.Fprintln(&w, "# HELP minfs_cache_evictions_total Cache entries evicted")
+	fmt.Fprintln(&w, "# TYPE minfs_cache_evictions_total counter")
+	fmt.Fprintf(&w, "minfs_cache_evictions_total %d\n", cacheStats.Evictions)
+
+	syncStats := mfs.SyncStats()
+	fmt.Fprintln(&w, "# HELP minfs_sync_queue_depth Pending write-back sync operations")
+	fmt.Fprintln(&w, "# TYPE minfs_sync_queue_depth gauge")
+	fmt.Fprintf(&w, "minfs_sync_queue_depth %d\n", syncStats.Pending)
+
+	fmt.Fprintln(&w, "# HELP minfs_sync_retries_total Write-back sync retry attempts")
+	fmt.Fprintln(&w, "# TYPE minfs_sync_retries_total counter")
+	fmt.Fprintf(&w, "minfs_sync_retries_total %d\n", syncStats.Retries)
+
+	fmt.Fprintln(&w, "# HELP minfs_fuse_ops_total FUSE operations, by op")
+	fmt.Fprintln(&w, "# TYPE minfs_fuse_ops_total counter")
+	for _, op := range mfs.opCounters.snapshot() {
+		fmt.Fprintf(&w, "minfs_fuse_ops_total{op=%q} %d\n", op.Name, op.Count)
+	}
+
+	mfs.s3Latency.writeProm(&w, "minfs_s3_request_duration_seconds")
+
+	return w.String()
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+// MoveOperation represents a pending rename/move of an object, enqueued on
+// syncChan so that it is applied to the backing bucket asynchronously.
+type MoveOperation struct {
+	// Backend is the name of the Backend the operation applies to.
+	Backend string
+
+	Source string
+	Target string
+}
+
+// CopyOperation represents a pending server-side copy of an object.
+type CopyOperation struct {
+	// Backend is the name of the Backend the operation applies to.
+	Backend string
+
+	Source string
+	Target string
+}
+
+// PutOperation represents a pending upload of a locally cached file to the
+// object store.
+type PutOperation struct {
+	// Backend is the name of the Backend the operation applies to.
+	Backend string
+
+	// Path is the destination object key.
+	Path string
+
+	// CachePath is the local cache file backing the upload.
+	CachePath string
+}
+
+// Sync enqueues op (a *MoveOperation, *CopyOperation or *PutOperation) onto
+// the write-back sync pipeline. It is exported so that other front-ends
+// (e.g. the WebDAV gateway) can push writes through the same pipeline the
+// FUSE mount uses instead of talking to the object store directly.
+func (mfs *MinFS) Sync(op interface{}) error {
+	return mfs.sync(op)
+}
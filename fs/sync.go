@@ -0,0 +1,416 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	"github.com/minio/minio-go/v7"
+)
+
+// syncBucket is the meta.DB bucket holding the durable write-back journal:
+// each entry is a pending MoveOperation/CopyOperation/PutOperation, keyed
+// by an 8-byte big-endian sequence number so entries replay in the order
+// they were enqueued.
+const syncBucket = "sync/"
+
+// syncRetries is the number of attempts a journal entry gets before it is
+// left in the journal for the next Serve() to retry.
+const syncRetries = 5
+
+// syncChanBufferSize bounds how many journaled operations sync() can hand
+// to the dispatcher before blocking the calling FUSE goroutine. Without
+// slack here, a single worker stuck in applyWithRetry's backoff (~1.5s of
+// sleeps across syncRetries attempts) would make every subsequent write -- against any
+// object, not just the stuck one -- block the instant the dispatcher's
+// send to mfs.syncChan has nowhere to land.
+const syncChanBufferSize = 256
+
+// syncWorkerBufferSize bounds how many jobs can queue for one worker
+// before the dispatcher blocks handing it the next. This is what actually
+// keeps one object's retries from head-of-line-blocking others: as long as
+// a worker's buffer isn't full, the dispatcher can route jobs for every
+// other object while that worker is busy retrying.
+const syncWorkerBufferSize = 64
+
+// CommitMode selects when a write is considered durable.
+type CommitMode string
+
+const (
+	// CommitWriteback acknowledges a write as soon as it is durably
+	// journaled in meta.DB and applies it to the backing bucket
+	// asynchronously. This is the default.
+	CommitWriteback CommitMode = "writeback"
+
+	// CommitWritethrough blocks the originating FUSE call until the
+	// corresponding minio-go call has succeeded.
+	CommitWritethrough CommitMode = "writethrough"
+)
+
+// SyncStats reports the current state of the write-back pipeline.
+type SyncStats struct {
+	Pending       int64
+	BytesInFlight int64
+	Retries       int64
+}
+
+// syncMetrics holds the counters backing SyncStats.
+type syncMetrics struct {
+	pending       int64
+	bytesInFlight int64
+	retries       int64
+}
+
+// SyncStats returns a snapshot of the write-back pipeline's current state,
+// for the status/metrics endpoint.
+func (mfs *MinFS) SyncStats() SyncStats {
+	return SyncStats{
+		Pending:       atomic.LoadInt64(&mfs.syncMetrics.pending),
+		BytesInFlight: atomic.LoadInt64(&mfs.syncMetrics.bytesInFlight),
+		Retries:       atomic.LoadInt64(&mfs.syncMetrics.retries),
+	}
+}
+
+// journalEntry is the on-disk representation of a queued operation.
+type journalEntry struct {
+	Seq  uint64
+	Move *MoveOperation `json:"Move,omitempty"`
+	Copy *CopyOperation `json:"Copy,omitempty"`
+	Put  *PutOperation  `json:"Put,omitempty"`
+}
+
+// key identifies the backend object entry's operation concerns, so that
+// startSync can route every journal entry touching the same object to the
+// same worker and keep them applying in enqueue order. A Move is keyed on
+// its Source, the name a racing Put against the not-yet-renamed object
+// would also use, since that is the ordering hazard the journal actually
+// needs to guard against.
+func (entry *journalEntry) key() string {
+	switch {
+	case entry.Move != nil:
+		return entry.Move.Backend + "/" + entry.Move.Source
+	case entry.Copy != nil:
+		return entry.Copy.Backend + "/" + entry.Copy.Source
+	case entry.Put != nil:
+		return entry.Put.Backend + "/" + entry.Put.Path
+	default:
+		return ""
+	}
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// journal durably persists op under the next sequence number in
+// syncBucket before the enqueuing FUSE call returns, so it survives a
+// crash between being accepted and being applied.
+func (mfs *MinFS) journal(op interface{}) (entry *journalEntry, err error) {
+	entry = &journalEntry{}
+	switch op := op.(type) {
+	case *MoveOperation:
+		entry.Move = op
+	case *CopyOperation:
+		entry.Copy = op
+	case *PutOperation:
+		entry.Put = op
+	default:
+		return nil, os.ErrInvalid
+	}
+
+	err = mfs.db.Update(func(tx *meta.Tx) error {
+		bucket, berr := tx.CreateBucketIfNotExists([]byte(syncBucket))
+		if berr != nil {
+			return berr
+		}
+
+		seq, serr := bucket.NextSequence()
+		if serr != nil {
+			return serr
+		}
+		entry.Seq = seq
+
+		data, merr := json.Marshal(entry)
+		if merr != nil {
+			return merr
+		}
+
+		return bucket.Put(seqKey(seq), data)
+	})
+
+	return entry, err
+}
+
+// unjournal removes a successfully applied entry from syncBucket.
+func (mfs *MinFS) unjournal(seq uint64) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(syncBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Delete(seqKey(seq))
+	})
+}
+
+// sync durably journals req and hands it to the worker pool. In
+// CommitWritethrough mode it blocks until a worker has applied it.
+func (mfs *MinFS) sync(req interface{}) error {
+	entry, err := mfs.journal(req)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&mfs.syncMetrics.pending, 1)
+
+	if mfs.config.commitMode == CommitWritethrough {
+		done := make(chan error, 1)
+		mfs.syncChan <- &syncJob{entry: entry, done: done}
+		return <-done
+	}
+
+	mfs.syncChan <- &syncJob{entry: entry}
+	return nil
+}
+
+// syncJob wraps a journalEntry with an optional completion channel used by
+// CommitWritethrough callers.
+type syncJob struct {
+	entry *journalEntry
+	done  chan error
+}
+
+// startSync launches the write-back worker pool. A dispatcher goroutine
+// reads jobs off syncChan and routes each one, by the FNV hash of its
+// journalEntry.key(), to one of concurrency per-worker channels -- every
+// job for a given object always lands on the same worker, so two
+// operations against the same object apply in the order they were
+// journaled even though distinct objects are applied concurrently. Workers
+// perform the corresponding minio-go call with exponential backoff retry,
+// and delete the journal entry on success.
+func (mfs *MinFS) startSync() error {
+	concurrency := mfs.config.syncConcurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	workers := make([]chan *syncJob, concurrency)
+	for i := range workers {
+		workers[i] = make(chan *syncJob, syncWorkerBufferSize)
+		worker := workers[i]
+		go func() {
+			for job := range worker {
+				err := mfs.applyWithRetry(job.entry)
+				if job.done != nil {
+					job.done <- err
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for job := range mfs.syncChan {
+			workers[workerFor(job.entry.key(), concurrency)] <- job
+		}
+		for _, worker := range workers {
+			close(worker)
+		}
+	}()
+
+	return nil
+}
+
+// workerFor hashes key to one of n worker indices.
+func workerFor(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32()) % n
+}
+
+// applyWithRetry performs entry's operation against the object store,
+// retrying with exponential backoff up to syncRetries times. The pending
+// counter is decremented either way. On success the journal entry is
+// removed; on exhausted retries the entry is left in the journal for the
+// next Serve() to replay, which counts it as pending again.
+func (mfs *MinFS) applyWithRetry(entry *journalEntry) error {
+	mfs.opCounters.inc("sync")
+	defer atomic.AddInt64(&mfs.syncMetrics.pending, -1)
+
+	var err error
+	backoff := 100 * time.Millisecond
+
+	for attempt := 0; attempt < syncRetries; attempt++ {
+		if attempt > 0 {
+			atomic.AddInt64(&mfs.syncMetrics.retries, 1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if err = mfs.apply(entry); err == nil {
+			return mfs.unjournal(entry.Seq)
+		}
+
+		mfs.log.Println("sync: attempt", attempt+1, "failed:", err)
+	}
+
+	return err
+}
+
+// apply performs the minio-go call corresponding to entry's operation.
+func (mfs *MinFS) apply(entry *journalEntry) error {
+	ctx := context.Background()
+
+	switch {
+	case entry.Move != nil:
+		return mfs.moveOp(ctx, entry.Move)
+	case entry.Copy != nil:
+		return mfs.copyOp(ctx, entry.Copy)
+	case entry.Put != nil:
+		return mfs.putOp(ctx, entry.Put)
+	default:
+		return os.ErrInvalid
+	}
+}
+
+func (mfs *MinFS) moveOp(ctx context.Context, req *MoveOperation) error {
+	if err := mfs.copyObject(ctx, req.Backend, req.Source, req.Target); err != nil {
+		return err
+	}
+
+	api, err := mfs.getApi(req.Backend)
+	if err != nil {
+		return err
+	}
+
+	b, err := mfs.backend(req.Backend)
+	if err != nil {
+		return err
+	}
+
+	return api.RemoveObject(ctx, b.Bucket, req.Source, minio.RemoveObjectOptions{})
+}
+
+func (mfs *MinFS) copyOp(ctx context.Context, req *CopyOperation) error {
+	return mfs.copyObject(ctx, req.Backend, req.Source, req.Target)
+}
+
+func (mfs *MinFS) copyObject(ctx context.Context, backend, source, target string) error {
+	sse, err := mfs.serverSide()
+	if err != nil {
+		return err
+	}
+
+	api, err := mfs.getApi(backend)
+	if err != nil {
+		return err
+	}
+
+	b, err := mfs.backend(backend)
+	if err != nil {
+		return err
+	}
+
+	dst := minio.CopyDestOptions{Bucket: b.Bucket, Object: target, Encryption: sse}
+	src := minio.CopySrcOptions{Bucket: b.Bucket, Object: source}
+	_, err = api.CopyObject(ctx, dst, src)
+	return err
+}
+
+func (mfs *MinFS) putOp(ctx context.Context, req *PutOperation) error {
+	sse, err := mfs.serverSide()
+	if err != nil {
+		return err
+	}
+
+	api, err := mfs.getApi(req.Backend)
+	if err != nil {
+		return err
+	}
+
+	b, err := mfs.backend(req.Backend)
+	if err != nil {
+		return err
+	}
+
+	// cacheLoad decrypts the cache file when it was encrypted at rest
+	// (SSE-C), so the bytes uploaded here are always plaintext.
+	data, err := mfs.cacheLoad(req.CachePath)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(data))
+	atomic.AddInt64(&mfs.syncMetrics.bytesInFlight, size)
+	defer atomic.AddInt64(&mfs.syncMetrics.bytesInFlight, -size)
+
+	if _, err = api.PutObject(ctx, b.Bucket, req.Path, bytes.NewReader(data), size, minio.PutObjectOptions{
+		ServerSideEncryption: sse,
+	}); err != nil {
+		return err
+	}
+
+	// The staging copy Flush wrote to req.CachePath (and registered
+	// against quota, see FileHandle.Flush) is no longer needed once it is
+	// durably in the backend -- remove it, and zero its index entry's size
+	// and clear its dirty flag, rather than leaving it to eviction.
+	if err := os.Remove(req.CachePath); err != nil && !os.IsNotExist(err) {
+		mfs.log.Println("sync: unable to remove uploaded cache file", req.CachePath, err)
+	}
+
+	return mfs.updateCacheSize(req.Backend+"/"+req.Path, req.CachePath, 0, false)
+}
+
+// replaySync scans syncBucket for entries left behind by a previous crash
+// and re-enqueues them, in sequence order, before the FUSE connection is
+// opened.
+func (mfs *MinFS) replaySync() error {
+	var entries []*journalEntry
+
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		bucket := tx.Bucket(syncBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			entry := &journalEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		atomic.AddInt64(&mfs.syncMetrics.pending, 1)
+		mfs.syncChan <- &syncJob{entry: entry}
+	}
+
+	return nil
+}